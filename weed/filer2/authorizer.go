@@ -0,0 +1,230 @@
+package filer2
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Identity is the caller passed into an Authorizer, carried on the
+// context.Context of every Filer call that can be access-controlled.
+type Identity struct {
+	Uid    uint32
+	Gid    uint32
+	Groups []uint32
+}
+
+func (id Identity) isInGroup(gid uint32) bool {
+	if id.Gid == gid {
+		return true
+	}
+	for _, g := range id.Groups {
+		if g == gid {
+			return true
+		}
+	}
+	return false
+}
+
+type identityContextKeyType struct{}
+
+var identityContextKey = identityContextKeyType{}
+
+// WithIdentity attaches the caller identity to ctx, for Filer calls that
+// need to authorize the operation.
+func WithIdentity(ctx context.Context, identity Identity) context.Context {
+	return context.WithValue(ctx, identityContextKey, identity)
+}
+
+// IdentityFromContext returns the identity attached by WithIdentity, if any.
+func IdentityFromContext(ctx context.Context) (Identity, bool) {
+	identity, ok := ctx.Value(identityContextKey).(Identity)
+	return identity, ok
+}
+
+// ErrPermissionDenied is returned by Filer operations when the Authorizer
+// rejects the caller.
+var ErrPermissionDenied = fmt.Errorf("permission denied")
+
+// Authorizer decides whether a caller identity may perform an operation
+// against a parent directory and/or target entry. CanCreate gets the parent
+// directory and the entry about to be created; CanDelete gets the parent
+// (nil when it is not found) and the entry; CanWrite and CanRead get a nil
+// parent and the existing entry (nil when it is not found).
+type Authorizer interface {
+	CanCreate(ctx context.Context, identity Identity, parent *Entry, entry *Entry) bool
+	CanRead(ctx context.Context, identity Identity, parent *Entry, entry *Entry) bool
+	CanWrite(ctx context.Context, identity Identity, parent *Entry, entry *Entry) bool
+	CanDelete(ctx context.Context, identity Identity, parent *Entry, entry *Entry) bool
+}
+
+// NoopAuthorizer allows everything, preserving the behavior of a Filer that
+// never had an Authorizer configured.
+type NoopAuthorizer struct{}
+
+func (NoopAuthorizer) CanCreate(context.Context, Identity, *Entry, *Entry) bool { return true }
+func (NoopAuthorizer) CanRead(context.Context, Identity, *Entry, *Entry) bool   { return true }
+func (NoopAuthorizer) CanWrite(context.Context, Identity, *Entry, *Entry) bool  { return true }
+func (NoopAuthorizer) CanDelete(context.Context, Identity, *Entry, *Entry) bool { return true }
+
+// The extended attribute keys POSIX uses for ACLs, stored on Entry.Attr.Extended.
+const (
+	aclAccessXattr  = "system.posix_acl_access"
+	aclDefaultXattr = "system.posix_acl_default"
+)
+
+// aclEntry is one line of a POSIX ACL: a tag (user/group/mask/other),
+// an optional qualifier (the specific uid/gid for "named user"/"named
+// group" entries), and the rwx permission bits it grants.
+type aclEntry struct {
+	tag       string // "user", "group", "mask", "other"
+	qualifier uint32
+	hasQual   bool
+	perm      os.FileMode
+}
+
+func parseACL(raw []byte) []aclEntry {
+	var entries []aclEntry
+	for _, line := range bytes.Split(raw, []byte("\n")) {
+		fields := strings.Split(strings.TrimSpace(string(line)), ":")
+		if len(fields) != 3 {
+			continue
+		}
+		perm, err := strconv.ParseUint(fields[2], 8, 32)
+		if err != nil {
+			continue
+		}
+		entry := aclEntry{tag: fields[0], perm: os.FileMode(perm)}
+		if fields[1] != "" {
+			if qualifier, err := strconv.ParseUint(fields[1], 10, 32); err == nil {
+				entry.qualifier = uint32(qualifier)
+				entry.hasQual = true
+			}
+		}
+		entries = append(entries, entry)
+	}
+	return entries
+}
+
+// PosixAuthorizer is the default Authorizer: it honors the standard owner/
+// group/other mode bits on Entry.Attr, with POSIX extended ACL entries
+// (stored as the "system.posix_acl_access" xattr) taking precedence when
+// present.
+type PosixAuthorizer struct{}
+
+func (PosixAuthorizer) CanCreate(ctx context.Context, identity Identity, parent *Entry, entry *Entry) bool {
+	return hasPermission(identity, parent, 03) // write + execute on the parent directory
+}
+
+func (PosixAuthorizer) CanRead(ctx context.Context, identity Identity, parent *Entry, entry *Entry) bool {
+	return hasPermission(identity, entry, 04)
+}
+
+func (PosixAuthorizer) CanWrite(ctx context.Context, identity Identity, parent *Entry, entry *Entry) bool {
+	return hasPermission(identity, entry, 02)
+}
+
+func (PosixAuthorizer) CanDelete(ctx context.Context, identity Identity, parent *Entry, entry *Entry) bool {
+	return hasPermission(identity, parent, 02)
+}
+
+// hasPermission reports whether identity holds every bit in want (some
+// combination of 04=read, 02=write, 01=execute) against target, first
+// checking its POSIX ACL and falling back to the plain owner/group/other
+// mode bits.
+func hasPermission(identity Identity, target *Entry, want os.FileMode) bool {
+	if target == nil {
+		return false
+	}
+
+	if raw, found := target.Extended[aclAccessXattr]; found {
+		if granted, ok := aclPermission(parseACL(raw), identity, target.Uid, target.Gid); ok {
+			return granted&want == want
+		}
+	}
+
+	mode := target.Mode
+	switch {
+	case identity.Uid == target.Uid:
+		return (mode>>6)&want == want
+	case identity.isInGroup(target.Gid):
+		return (mode>>3)&want == want
+	default:
+		return mode&want == want
+	}
+}
+
+// aclPermission evaluates a parsed ACL for identity against the target
+// entry's owner (targetUid) and owning group (targetGid), following the
+// usual POSIX precedence: the unqualified "user" entry is the owner's own
+// slot and applies only to identity.Uid == targetUid; a matching named
+// (qualified) user entry wins next; otherwise the matching group entry with
+// the largest permission value (compared as a number, not bit by bit) -- the unqualified "group" entry applying only to members of
+// targetGid, named (qualified) group entries applying to members of that
+// group -- is masked by the "mask" entry.
+func aclPermission(entries []aclEntry, identity Identity, targetUid, targetGid uint32) (os.FileMode, bool) {
+	var (
+		owningUserPerm os.FileMode
+		haveOwningUser bool
+		namedUserPerm  os.FileMode
+		haveNamedUser  bool
+		groupPerm      os.FileMode
+		haveGroup      bool
+		mask           os.FileMode = 07
+		haveMask       bool
+		otherPerm      os.FileMode
+		haveOther      bool
+	)
+
+	for _, entry := range entries {
+		switch entry.tag {
+		case "user":
+			if entry.hasQual {
+				if entry.qualifier == identity.Uid {
+					namedUserPerm, haveNamedUser = entry.perm, true
+				}
+			} else if identity.Uid == targetUid {
+				owningUserPerm, haveOwningUser = entry.perm, true
+			}
+		case "group":
+			var qualifier uint32
+			if entry.hasQual {
+				qualifier = entry.qualifier
+			} else {
+				qualifier = targetGid
+			}
+			if identity.isInGroup(qualifier) {
+				if entry.perm > groupPerm || !haveGroup {
+					groupPerm, haveGroup = entry.perm, true
+				}
+			}
+		case "mask":
+			mask, haveMask = entry.perm, true
+		case "other":
+			otherPerm, haveOther = entry.perm, true
+		}
+	}
+
+	if haveOwningUser {
+		return owningUserPerm, true
+	}
+	if haveNamedUser {
+		if haveMask {
+			return namedUserPerm & mask, true
+		}
+		return namedUserPerm, true
+	}
+	if haveGroup {
+		if haveMask {
+			return groupPerm & mask, true
+		}
+		return groupPerm, true
+	}
+	if haveOther {
+		return otherPerm, true
+	}
+	return 0, false
+}
@@ -0,0 +1,113 @@
+package filer2
+
+import (
+	"strings"
+	"testing"
+)
+
+func acl(lines ...string) []byte {
+	return []byte(strings.Join(lines, "\n"))
+}
+
+// TestHasPermissionOwningGroupRequiresMembership is the regression test for
+// the bug where an unqualified "group::perm" ACL entry -- the common case
+// present in essentially every real POSIX ACL -- was granted to any caller
+// regardless of actual group membership.
+func TestHasPermissionOwningGroupRequiresMembership(t *testing.T) {
+	target := &Entry{
+		Attr: Attr{
+			Mode: 0640,
+			Uid:  100,
+			Gid:  200,
+			Extended: map[string][]byte{
+				aclAccessXattr: acl("user::6", "group::6", "other::0"),
+			},
+		},
+	}
+
+	member := Identity{Uid: 999, Gid: 200}
+	if !hasPermission(member, target, 04) {
+		t.Fatalf("member of the owning group should be granted read by the unqualified group entry")
+	}
+
+	stranger := Identity{Uid: 999, Gid: 300}
+	if hasPermission(stranger, target, 04) {
+		t.Fatalf("identity outside the owning group must not be granted read by the unqualified group entry")
+	}
+}
+
+// TestHasPermissionOwningUserEntryApplies verifies the unqualified
+// "user::perm" entry -- the owner's own slot -- is applied to the owner
+// even when it was never being matched before (it was only ever treated as
+// a named-user entry, which requires hasQual).
+func TestHasPermissionOwningUserEntryApplies(t *testing.T) {
+	target := &Entry{
+		Attr: Attr{
+			Mode: 0000,
+			Uid:  100,
+			Gid:  200,
+			Extended: map[string][]byte{
+				aclAccessXattr: acl("user::6", "group::0", "other::0"),
+			},
+		},
+	}
+
+	owner := Identity{Uid: 100, Gid: 999}
+	if !hasPermission(owner, target, 06) {
+		t.Fatalf("owner should be granted read+write by the unqualified user entry")
+	}
+
+	nonOwner := Identity{Uid: 101, Gid: 200}
+	if hasPermission(nonOwner, target, 04) {
+		t.Fatalf("non-owner must not be granted the owning user entry's permission")
+	}
+}
+
+// TestHasPermissionNamedUserAndGroup verifies named (qualified) user/group
+// entries apply to the specific uid/gid they name, masked by "mask".
+func TestHasPermissionNamedUserAndGroup(t *testing.T) {
+	target := &Entry{
+		Attr: Attr{
+			Mode: 0000,
+			Uid:  100,
+			Gid:  200,
+			Extended: map[string][]byte{
+				aclAccessXattr: acl("user::0", "user:300:6", "group::0", "group:400:6", "mask::4", "other::0"),
+			},
+		},
+	}
+
+	namedUser := Identity{Uid: 300, Gid: 999}
+	if !hasPermission(namedUser, target, 04) {
+		t.Fatalf("named user should be granted read (masked down from rw)")
+	}
+	if hasPermission(namedUser, target, 02) {
+		t.Fatalf("named user's write bit should have been masked off")
+	}
+
+	namedGroupMember := Identity{Uid: 999, Gid: 400}
+	if !hasPermission(namedGroupMember, target, 04) {
+		t.Fatalf("member of the named group should be granted read (masked down from rw)")
+	}
+
+	unrelated := Identity{Uid: 999, Gid: 999}
+	if hasPermission(unrelated, target, 04) {
+		t.Fatalf("identity matching no entry should fall through to other::0")
+	}
+}
+
+// TestHasPermissionFallsBackToModeBits verifies that when no ACL xattr is
+// present, permission is decided by the plain owner/group/other mode bits.
+func TestHasPermissionFallsBackToModeBits(t *testing.T) {
+	target := &Entry{Attr: Attr{Mode: 0640, Uid: 100, Gid: 200}}
+
+	if !hasPermission(Identity{Uid: 100, Gid: 999}, target, 06) {
+		t.Fatalf("owner should have read+write from the mode bits")
+	}
+	if !hasPermission(Identity{Uid: 999, Gid: 200}, target, 04) {
+		t.Fatalf("group member should have read from the mode bits")
+	}
+	if hasPermission(Identity{Uid: 999, Gid: 999}, target, 04) {
+		t.Fatalf("unrelated identity should have no permission from the mode bits")
+	}
+}
@@ -2,10 +2,13 @@ package filer2
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"os"
 	"path/filepath"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/chrislusf/seaweedfs/weed/glog"
@@ -15,23 +18,69 @@ import (
 	"github.com/karlseguin/ccache"
 )
 
+// defaultDeletionPageSize and defaultDeletionConcurrency bound a recursive
+// DeleteEntryMetaAndData: how many children are fetched per listing page,
+// and how many of them are deleted at once.
+const (
+	defaultDeletionPageSize    = 1024
+	defaultDeletionConcurrency = 16
+)
+
 type Filer struct {
 	store          FilerStore
 	directoryCache *ccache.Cache
 	MasterClient   *wdclient.MasterClient
+
+	subscribersLock sync.RWMutex
+	subscribers     map[*subscription]struct{}
+	eventSequence   uint64
+
+	memDeletionQueueOnce sync.Once
+	memDeletionQueue     *memDeletionQueue
+	deletionQueueDepth   int64
+	deletionFailureCount uint64
+
+	authorizer Authorizer
+
+	deletionPageSize    int
+	deletionConcurrency int
 }
 
 func NewFiler(masters []string) *Filer {
 	return &Filer{
-		directoryCache: ccache.New(ccache.Configure().MaxSize(1000).ItemsToPrune(100)),
-		MasterClient:   wdclient.NewMasterClient(context.Background(), "filer", masters),
+		directoryCache:      ccache.New(ccache.Configure().MaxSize(1000).ItemsToPrune(100)),
+		MasterClient:        wdclient.NewMasterClient(context.Background(), "filer", masters),
+		subscribers:         make(map[*subscription]struct{}),
+		authorizer:          NoopAuthorizer{},
+		deletionPageSize:    defaultDeletionPageSize,
+		deletionConcurrency: defaultDeletionConcurrency,
 	}
 }
 
+// SetDeletionPageSize overrides how many directory children are fetched per
+// page during a recursive DeleteEntryMetaAndData.
+func (f *Filer) SetDeletionPageSize(pageSize int) {
+	f.deletionPageSize = pageSize
+}
+
+// SetDeletionConcurrency overrides how many children are deleted at once
+// during a recursive DeleteEntryMetaAndData.
+func (f *Filer) SetDeletionConcurrency(concurrency int) {
+	f.deletionConcurrency = concurrency
+}
+
 func (f *Filer) SetStore(store FilerStore) {
 	f.store = store
 }
 
+// SetAuthorizer installs the Authorizer consulted by CreateEntry,
+// UpdateEntry, DeleteEntryMetaAndData, and ListDirectoryEntries. A Filer
+// defaults to NoopAuthorizer, so calling this is opt-in and does not
+// change behavior for existing deployments until they do.
+func (f *Filer) SetAuthorizer(authorizer Authorizer) {
+	f.authorizer = authorizer
+}
+
 func (f *Filer) DisableDirectoryCache() {
 	f.directoryCache = nil
 }
@@ -44,7 +93,14 @@ func (fs *Filer) KeepConnectedToMaster() {
 	fs.MasterClient.KeepConnectedToMaster()
 }
 
+// CreateEntry is the context-less form of CreateEntryWithContext, kept for
+// callers that predate the Authorizer and have no identity to attach. It
+// authorizes as the zero-value Identity.
 func (f *Filer) CreateEntry(entry *Entry) error {
+	return f.CreateEntryWithContext(context.Background(), entry)
+}
+
+func (f *Filer) CreateEntryWithContext(ctx context.Context, entry *Entry) error {
 
 	dirParts := strings.Split(string(entry.FullPath), "/")
 
@@ -107,13 +163,12 @@ func (f *Filer) CreateEntry(entry *Entry) error {
 		return fmt.Errorf("parent folder not found: %v", entry.FullPath)
 	}
 
-	/*
-		if !hasWritePermission(lastDirectoryEntry, entry) {
-			glog.V(0).Infof("directory %s: %v, entry: uid=%d gid=%d",
-				lastDirectoryEntry.FullPath, lastDirectoryEntry.Attr, entry.Uid, entry.Gid)
-			return fmt.Errorf("no write permission in folder %v", lastDirectoryEntry.FullPath)
-		}
-	*/
+	identity, _ := IdentityFromContext(ctx)
+	if !f.authorizer.CanCreate(ctx, identity, lastDirectoryEntry, entry) {
+		glog.V(0).Infof("directory %s: %v, entry: uid=%d gid=%d",
+			lastDirectoryEntry.FullPath, lastDirectoryEntry.Attr, entry.Uid, entry.Gid)
+		return fmt.Errorf("no write permission in folder %v: %v", lastDirectoryEntry.FullPath, ErrPermissionDenied)
+	}
 
 	oldEntry, _ := f.FindEntry(entry.FullPath)
 
@@ -121,53 +176,180 @@ func (f *Filer) CreateEntry(entry *Entry) error {
 		return fmt.Errorf("insert entry %s: %v", entry.FullPath, err)
 	}
 
+	f.publish(&Event{Type: EntryCreated, Path: entry.FullPath, NewEntry: entry})
+
 	f.deleteChunksIfNotNew(oldEntry, entry)
 
 	return nil
 }
 
-func (f *Filer) UpdateEntry(entry *Entry) (err error) {
-	return f.store.UpdateEntry(entry)
+// UpdateEntry is the context-less form of UpdateEntryWithContext, kept for
+// callers that predate the Authorizer and have no identity to attach. It
+// authorizes as the zero-value Identity.
+func (f *Filer) UpdateEntry(entry *Entry) error {
+	return f.UpdateEntryWithContext(context.Background(), entry)
+}
+
+func (f *Filer) UpdateEntryWithContext(ctx context.Context, entry *Entry) (err error) {
+	oldEntry, _ := f.FindEntry(entry.FullPath)
+
+	identity, _ := IdentityFromContext(ctx)
+	if !f.authorizer.CanWrite(ctx, identity, nil, oldEntry) {
+		return fmt.Errorf("update entry %v: %v", entry.FullPath, ErrPermissionDenied)
+	}
+
+	if err = f.store.UpdateEntry(entry); err != nil {
+		return err
+	}
+	f.publish(&Event{Type: EntryUpdated, Path: entry.FullPath, OldEntry: oldEntry, NewEntry: entry})
+	return nil
 }
 
 func (f *Filer) FindEntry(p FullPath) (entry *Entry, err error) {
 	return f.store.FindEntry(p)
 }
 
-func (f *Filer) DeleteEntryMetaAndData(p FullPath, isRecursive bool, shouldDeleteChunks bool) (err error) {
+// DeleteEntryMetaAndData is the context-less, non-continue-on-error form of
+// DeleteEntryMetaAndDataWithContext, kept for callers that predate the
+// Authorizer and the recursive-delete error policy: it authorizes as the
+// zero-value Identity and stops at the first error, as it always has.
+func (f *Filer) DeleteEntryMetaAndData(p FullPath, isRecursive, shouldDeleteChunks bool) error {
+	return f.DeleteEntryMetaAndDataWithContext(context.Background(), p, isRecursive, shouldDeleteChunks, false)
+}
+
+// DeleteEntryMetaAndDataWithContext deletes p. If p is a directory and
+// isRecursive is set, every descendant is deleted too, paging through all of
+// them (rather than just the first one) and deleting siblings concurrently
+// through a bounded worker pool. continueOnError controls whether a failure
+// deleting one child aborts the rest of the subtree or is merely recorded
+// and walked past; either way every error encountered is returned, joined
+// together.
+func (f *Filer) DeleteEntryMetaAndDataWithContext(ctx context.Context, p FullPath, isRecursive, shouldDeleteChunks, continueOnError bool) (err error) {
 	entry, err := f.FindEntry(p)
 	if err != nil {
 		return err
 	}
 
+	identity, _ := IdentityFromContext(ctx)
+	parent, _ := f.FindEntry(p.ParentPath())
+	if !f.authorizer.CanDelete(ctx, identity, parent, entry) {
+		return fmt.Errorf("delete entry %v: %v", p, ErrPermissionDenied)
+	}
+
 	if entry.IsDirectory() {
-		entries, err := f.ListDirectoryEntries(p, "", false, 1)
-		if err != nil {
-			return fmt.Errorf("list folder %s: %v", p, err)
-		}
-		if isRecursive {
-			for _, sub := range entries {
-				f.DeleteEntryMetaAndData(sub.FullPath, isRecursive, shouldDeleteChunks)
-			}
-		} else {
-			if len(entries) > 0 {
-				return fmt.Errorf("folder %s is not empty", p)
-			}
+		if err := f.deleteDirectoryChildren(ctx, p, isRecursive, shouldDeleteChunks, continueOnError); err != nil {
+			return err
 		}
 		f.cacheDelDirectory(string(p))
 	}
 
 	if shouldDeleteChunks {
+		if isSnapshotPath(p) {
+			// p is itself a snapshot clone: it was the thing holding a
+			// chunk ref count bump in cloneSubtree, so removing it has to
+			// give that reference back, or the chunk would be held
+			// referenced forever even after every snapshot of it is gone.
+			f.refChunks(entry.Chunks, -1)
+		}
 		f.deleteChunks(entry.Chunks)
 	}
 
-	return f.store.DeleteEntry(p)
+	if err = f.store.DeleteEntry(p); err != nil {
+		return err
+	}
+
+	f.publish(&Event{Type: EntryDeleted, Path: p, OldEntry: entry})
+
+	return nil
 }
 
+// deleteDirectoryChildren pages through every child of the directory p,
+// fetching up to f.deletionPageSize at a time instead of just the first
+// one, and -- when isRecursive -- deletes siblings concurrently through a
+// worker pool bounded by f.deletionConcurrency. Every error is recorded;
+// if continueOnError is false the walk stops at the first one, otherwise
+// it keeps going and everything gathered is returned joined together.
+func (f *Filer) deleteDirectoryChildren(ctx context.Context, p FullPath, isRecursive, shouldDeleteChunks, continueOnError bool) error {
+
+	var (
+		mu      sync.Mutex
+		errs    []error
+		wg      sync.WaitGroup
+		sem     = make(chan struct{}, f.deletionConcurrency)
+		stopped int32
+	)
+
+	recordErr := func(err error) {
+		mu.Lock()
+		errs = append(errs, err)
+		mu.Unlock()
+		if !continueOnError {
+			atomic.StoreInt32(&stopped, 1)
+		}
+	}
+
+	startFileName := ""
+	for atomic.LoadInt32(&stopped) == 0 {
+
+		children, err := f.ListDirectoryEntriesWithContext(ctx, p, startFileName, false, f.deletionPageSize)
+		if err != nil {
+			recordErr(fmt.Errorf("list folder %s: %v", p, err))
+			break
+		}
+		if len(children) == 0 {
+			break
+		}
+
+		if !isRecursive {
+			return fmt.Errorf("folder %s is not empty", p)
+		}
+
+		for _, sub := range children {
+			if atomic.LoadInt32(&stopped) != 0 {
+				break
+			}
+			sub := sub
+			sem <- struct{}{}
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				defer func() { <-sem }()
+				if err := f.DeleteEntryMetaAndDataWithContext(ctx, sub.FullPath, isRecursive, shouldDeleteChunks, continueOnError); err != nil {
+					recordErr(fmt.Errorf("delete %s: %v", sub.FullPath, err))
+				}
+			}()
+		}
+
+		startFileName = children[len(children)-1].FullPath.Name()
+		if len(children) < f.deletionPageSize {
+			break
+		}
+	}
+
+	wg.Wait()
+
+	return errors.Join(errs...)
+}
+
+// ListDirectoryEntries is the context-less form of
+// ListDirectoryEntriesWithContext, kept for callers that predate the
+// Authorizer and have no identity to attach. It authorizes as the
+// zero-value Identity.
 func (f *Filer) ListDirectoryEntries(p FullPath, startFileName string, inclusive bool, limit int) ([]*Entry, error) {
+	return f.ListDirectoryEntriesWithContext(context.Background(), p, startFileName, inclusive, limit)
+}
+
+func (f *Filer) ListDirectoryEntriesWithContext(ctx context.Context, p FullPath, startFileName string, inclusive bool, limit int) ([]*Entry, error) {
 	if strings.HasSuffix(string(p), "/") && len(p) > 1 {
 		p = p[0 : len(p)-1]
 	}
+
+	identity, _ := IdentityFromContext(ctx)
+	dirEntry, _ := f.FindEntry(p)
+	if !f.authorizer.CanRead(ctx, identity, nil, dirEntry) {
+		return nil, fmt.Errorf("list folder %v: %v", p, ErrPermissionDenied)
+	}
+
 	return f.store.ListDirectoryEntries(p, startFileName, inclusive, limit)
 }
 
@@ -204,10 +386,16 @@ func (f *Filer) cacheSetDirectory(dirpath string, dirEntry *Entry, level int) {
 	f.directoryCache.Set(dirpath, dirEntry, time.Duration(minutes)*time.Minute)
 }
 
+// deleteChunks used to delete chunks synchronously, one at a time, and
+// silently drop any that failed. It now just hands them to the persistent
+// deletion queue; StartDeletionWorker is what actually reclaims them, in
+// batches, with retry.
 func (f *Filer) deleteChunks(chunks []*filer_pb.FileChunk) {
-	for _, chunk := range chunks {
-		f.DeleteFileByFileId(chunk.FileId)
+	if len(chunks) == 0 {
+		return
 	}
+	f.enqueueChunkDeletions(chunks)
+	f.publish(&Event{Type: ChunksGarbageCollected})
 }
 
 func (f *Filer) DeleteFileByFileId(fileId string) {
@@ -0,0 +1,268 @@
+package filer2
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/chrislusf/seaweedfs/weed/glog"
+	"github.com/chrislusf/seaweedfs/weed/operation"
+	"github.com/chrislusf/seaweedfs/weed/pb/filer_pb"
+)
+
+// deletionBatchSize bounds how many file IDs are looked up and deleted
+// together in one pass of the worker.
+const deletionBatchSize = 1000
+
+// deletionInitialBackoff and deletionMaxBackoff bound the exponential
+// backoff applied to a file ID that keeps failing to delete.
+const (
+	deletionInitialBackoff = 1 * time.Second
+	deletionMaxBackoff     = 5 * time.Minute
+)
+
+// DeletionTask is a single file ID waiting to be reclaimed on a volume
+// server, along with how many times it has already been tried.
+type DeletionTask struct {
+	FileId      string
+	Attempts    int
+	NextRetryAt time.Time
+}
+
+// DeletionQueueStore is implemented by a FilerStore that can durably queue
+// chunk deletions, so that a crash between enqueue and a successful delete
+// on the volume server does not leak the chunk forever. Stores that do not
+// implement it fall back to an in-process queue, which is best-effort only.
+type DeletionQueueStore interface {
+	EnqueueDeletions(fileIds []string) error
+	FetchDueDeletions(now time.Time, limit int) ([]*DeletionTask, error)
+	AckDeletion(fileId string) error
+	RescheduleDeletion(fileId string, attempts int, nextRetryAt time.Time) error
+	CountDeletions() (int, error)
+}
+
+// memDeletionQueue is the fallback used when the FilerStore does not
+// implement DeletionQueueStore.
+type memDeletionQueue struct {
+	mu    sync.Mutex
+	tasks map[string]*DeletionTask
+}
+
+func newMemDeletionQueue() *memDeletionQueue {
+	return &memDeletionQueue{tasks: make(map[string]*DeletionTask)}
+}
+
+func (q *memDeletionQueue) EnqueueDeletions(fileIds []string) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for _, fileId := range fileIds {
+		if _, found := q.tasks[fileId]; !found {
+			q.tasks[fileId] = &DeletionTask{FileId: fileId}
+		}
+	}
+	return nil
+}
+
+func (q *memDeletionQueue) FetchDueDeletions(now time.Time, limit int) (due []*DeletionTask, err error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for _, task := range q.tasks {
+		if len(due) >= limit {
+			break
+		}
+		if task.NextRetryAt.After(now) {
+			continue
+		}
+		due = append(due, task)
+	}
+	return due, nil
+}
+
+func (q *memDeletionQueue) AckDeletion(fileId string) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	delete(q.tasks, fileId)
+	return nil
+}
+
+func (q *memDeletionQueue) RescheduleDeletion(fileId string, attempts int, nextRetryAt time.Time) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if task, found := q.tasks[fileId]; found {
+		task.Attempts = attempts
+		task.NextRetryAt = nextRetryAt
+	}
+	return nil
+}
+
+func (q *memDeletionQueue) CountDeletions() (int, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return len(q.tasks), nil
+}
+
+func (f *Filer) deletionQueueStore() DeletionQueueStore {
+	if store, ok := f.store.(DeletionQueueStore); ok {
+		return store
+	}
+	f.memDeletionQueueOnce.Do(func() {
+		f.memDeletionQueue = newMemDeletionQueue()
+	})
+	return f.memDeletionQueue
+}
+
+// enqueueChunkDeletions replaces the old synchronous per-chunk delete loop:
+// it durably records the intent to delete, and lets the background worker
+// started by StartDeletionWorker actually reclaim the chunks, with retry.
+func (f *Filer) enqueueChunkDeletions(chunks []*filer_pb.FileChunk) {
+	if len(chunks) == 0 {
+		return
+	}
+
+	var fileIds []string
+	for _, chunk := range chunks {
+		if f.isChunkReferenced(chunk.FileId) {
+			glog.V(2).Infof("chunk %s still referenced by a snapshot, keeping", chunk.FileId)
+			continue
+		}
+		fileIds = append(fileIds, chunk.FileId)
+	}
+	if len(fileIds) == 0 {
+		return
+	}
+
+	if err := f.deletionQueueStore().EnqueueDeletions(fileIds); err != nil {
+		glog.V(0).Infof("enqueue %d chunk deletions: %v", len(fileIds), err)
+		return
+	}
+
+	atomic.AddInt64(&f.deletionQueueDepth, int64(len(fileIds)))
+}
+
+// StartDeletionWorker runs the batched deletion worker until ctx is done.
+// It should be started once, by whichever process owns this Filer.
+func (f *Filer) StartDeletionWorker(ctx context.Context) {
+	go func() {
+		ticker := time.NewTicker(1 * time.Second)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				f.processDueDeletions(time.Now())
+			}
+		}
+	}()
+}
+
+// FlushDeletions synchronously drains every due deletion. It exists so
+// tests don't have to wait on the background worker's ticker.
+func (f *Filer) FlushDeletions(ctx context.Context) error {
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		default:
+		}
+		if f.processDueDeletions(time.Now()) == 0 {
+			return nil
+		}
+	}
+}
+
+// processDueDeletions fetches one batch of due deletions, groups them by
+// the volume server that holds them, and issues a bulk delete per server
+// with exponential-backoff retry on failure. It returns how many tasks it
+// attempted, so callers can tell when the queue is drained.
+func (f *Filer) processDueDeletions(now time.Time) int {
+
+	queue := f.deletionQueueStore()
+
+	tasks, err := queue.FetchDueDeletions(now, deletionBatchSize)
+	if err != nil {
+		glog.V(0).Infof("fetch due deletions: %v", err)
+		return 0
+	}
+	if len(tasks) == 0 {
+		return 0
+	}
+
+	byVolumeServer := make(map[string][]*DeletionTask)
+	for _, task := range tasks {
+		volumeServer, lookupErr := f.MasterClient.LookupFileId(task.FileId)
+		if lookupErr != nil {
+			f.retryDeletion(queue, task, lookupErr)
+			continue
+		}
+		byVolumeServer[volumeServer] = append(byVolumeServer[volumeServer], task)
+	}
+
+	for volumeServer, serverTasks := range byVolumeServer {
+		fileIds := make([]string, len(serverTasks))
+		for i, task := range serverTasks {
+			fileIds[i] = task.FileId
+		}
+
+		results, deleteErr := operation.DeleteFiles(volumeServer, fileIds)
+		if deleteErr != nil {
+			for _, task := range serverTasks {
+				f.retryDeletion(queue, task, deleteErr)
+			}
+			continue
+		}
+
+		failed := make(map[string]error)
+		for _, result := range results {
+			if result.Error != "" {
+				failed[result.FileId] = fmt.Errorf(result.Error)
+			}
+		}
+
+		for _, task := range serverTasks {
+			if resultErr, hasFailed := failed[task.FileId]; hasFailed {
+				f.retryDeletion(queue, task, resultErr)
+				continue
+			}
+			if err := queue.AckDeletion(task.FileId); err != nil {
+				glog.V(0).Infof("ack deletion of %s: %v", task.FileId, err)
+			}
+			atomic.AddInt64(&f.deletionQueueDepth, -1)
+		}
+	}
+
+	return len(tasks)
+}
+
+func (f *Filer) retryDeletion(queue DeletionQueueStore, task *DeletionTask, cause error) {
+	atomic.AddUint64(&f.deletionFailureCount, 1)
+	task.Attempts++
+	backoff := deletionInitialBackoff << uint(task.Attempts-1)
+	if backoff <= 0 || backoff > deletionMaxBackoff {
+		backoff = deletionMaxBackoff
+	}
+	nextRetryAt := time.Now().Add(backoff)
+	glog.V(1).Infof("deleting chunk %s failed (attempt %d), retrying at %v: %v", task.FileId, task.Attempts, nextRetryAt, cause)
+	if err := queue.RescheduleDeletion(task.FileId, task.Attempts, nextRetryAt); err != nil {
+		glog.V(0).Infof("reschedule deletion of %s: %v", task.FileId, err)
+	}
+}
+
+// DeletionQueueDepth reports how many chunk deletions are enqueued but not
+// yet confirmed reclaimed, for monitoring.
+func (f *Filer) DeletionQueueDepth() int {
+	if store, ok := f.store.(DeletionQueueStore); ok {
+		if count, err := store.CountDeletions(); err == nil {
+			return count
+		}
+	}
+	return int(atomic.LoadInt64(&f.deletionQueueDepth))
+}
+
+// DeletionFailureCount reports how many deletion attempts have failed and
+// been rescheduled, for monitoring.
+func (f *Filer) DeletionFailureCount() uint64 {
+	return atomic.LoadUint64(&f.deletionFailureCount)
+}
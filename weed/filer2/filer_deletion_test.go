@@ -0,0 +1,180 @@
+package filer2
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sync"
+	"testing"
+
+	"github.com/chrislusf/seaweedfs/weed/pb/filer_pb"
+)
+
+// memFilerStore is a minimal in-memory FilerStore used only by tests in
+// this package. It also implements ChunkRefCountStore so snapshot tests
+// can exercise the real ref-counting path instead of the "store has no
+// snapshots" fallback.
+type memFilerStore struct {
+	mu        sync.Mutex
+	entries   map[FullPath]*Entry
+	refCounts map[string]int
+}
+
+func newMemFilerStore() *memFilerStore {
+	return &memFilerStore{
+		entries:   make(map[FullPath]*Entry),
+		refCounts: make(map[string]int),
+	}
+}
+
+func (s *memFilerStore) IncrementChunkRefCount(fileId string, delta int) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.refCounts[fileId] += delta
+	return s.refCounts[fileId], nil
+}
+
+func (s *memFilerStore) GetChunkRefCount(fileId string) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.refCounts[fileId], nil
+}
+
+func (s *memFilerStore) InsertEntry(entry *Entry) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.entries[entry.FullPath] = entry
+	return nil
+}
+
+func (s *memFilerStore) UpdateEntry(entry *Entry) error {
+	return s.InsertEntry(entry)
+}
+
+func (s *memFilerStore) FindEntry(p FullPath) (*Entry, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	entry, found := s.entries[p]
+	if !found {
+		return nil, fmt.Errorf("%s not found", p)
+	}
+	return entry, nil
+}
+
+func (s *memFilerStore) DeleteEntry(p FullPath) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.entries, p)
+	return nil
+}
+
+func (s *memFilerStore) ListDirectoryEntries(dirPath FullPath, startFileName string, inclusive bool, limit int) (entries []*Entry, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for p, entry := range s.entries {
+		if p.ParentPath() != dirPath {
+			continue
+		}
+		name := p.Name()
+		if name < startFileName || (!inclusive && name == startFileName) {
+			continue
+		}
+		entries = append(entries, entry)
+	}
+
+	sortEntriesByName(entries)
+
+	if limit > 0 && len(entries) > limit {
+		entries = entries[:limit]
+	}
+
+	return entries, nil
+}
+
+func sortEntriesByName(entries []*Entry) {
+	for i := 1; i < len(entries); i++ {
+		for j := i; j > 0 && entries[j].FullPath.Name() < entries[j-1].FullPath.Name(); j-- {
+			entries[j], entries[j-1] = entries[j-1], entries[j]
+		}
+	}
+}
+
+// buildTree creates a directory tree under root that is both wide (many
+// siblings per directory) and deep (several levels), so that a recursive
+// delete has to both page through children and recurse.
+func buildTree(t *testing.T, f *Filer, root FullPath, width, depth int) (fileCount int) {
+	t.Helper()
+	if err := f.CreateEntryWithContext(context.Background(), &Entry{
+		FullPath: root,
+		Attr:     Attr{Mode: os.ModeDir | 0755},
+	}); err != nil {
+		t.Fatalf("create dir %s: %v", root, err)
+	}
+
+	for i := 0; i < width; i++ {
+		filePath := root.Child(fmt.Sprintf("file-%d", i))
+		if err := f.CreateEntryWithContext(context.Background(), &Entry{
+			FullPath: filePath,
+			Attr:     Attr{Mode: 0644},
+			Chunks:   []*filer_pb.FileChunk{{FileId: fmt.Sprintf("%s,fid", filePath)}},
+		}); err != nil {
+			t.Fatalf("create file %s: %v", filePath, err)
+		}
+		fileCount++
+	}
+
+	if depth == 0 {
+		return fileCount
+	}
+
+	for i := 0; i < width; i++ {
+		subDir := root.Child(fmt.Sprintf("dir-%d", i))
+		fileCount += buildTree(t, f, subDir, width, depth-1)
+	}
+
+	return fileCount
+}
+
+// TestDeleteEntryMetaAndDataRecursive builds a wide+deep tree and verifies
+// that a recursive delete removes every entry, including the ones past the
+// first page -- the previous implementation only ever listed a single
+// child (limit=1) before recursing and silently left the rest behind.
+func TestDeleteEntryMetaAndDataRecursive(t *testing.T) {
+	f := NewFiler(nil)
+	f.SetStore(newMemFilerStore())
+	f.SetDeletionPageSize(4)
+	f.SetDeletionConcurrency(8)
+
+	const width, depth = 12, 3
+	root := FullPath("/tree")
+	fileCount := buildTree(t, f, root, width, depth)
+
+	ctx := context.Background()
+	if err := f.DeleteEntryMetaAndDataWithContext(ctx, root, true, true, false); err != nil {
+		t.Fatalf("recursive delete failed: %v", err)
+	}
+
+	if _, err := f.FindEntry(root); err == nil {
+		t.Fatalf("root %s should have been deleted", root)
+	}
+
+	store := f.store.(*memFilerStore)
+	store.mu.Lock()
+	for p := range store.entries {
+		// "/" was created by CreateEntry as the parent of root and is not
+		// part of the deleted subtree.
+		if p == "/" {
+			continue
+		}
+		t.Errorf("entry %s survived the recursive delete", p)
+	}
+	store.mu.Unlock()
+
+	// Every file created by buildTree carries exactly one chunk, and none
+	// of them is snapshotted, so the recursive delete must have enqueued
+	// all of them for deletion -- not just removed the metadata entries.
+	if depth := f.DeletionQueueDepth(); depth != fileCount {
+		t.Fatalf("expected %d chunks queued for deletion, got queue depth %d", fileCount, depth)
+	}
+}
@@ -0,0 +1,191 @@
+package filer2
+
+import (
+	"context"
+	"strings"
+	"sync/atomic"
+
+	"github.com/chrislusf/seaweedfs/weed/glog"
+)
+
+// EventType identifies the kind of change that happened to a path.
+type EventType int
+
+const (
+	EntryCreated EventType = iota
+	EntryUpdated
+	EntryDeleted
+	ChunksGarbageCollected
+)
+
+func (t EventType) String() string {
+	switch t {
+	case EntryCreated:
+		return "EntryCreated"
+	case EntryUpdated:
+		return "EntryUpdated"
+	case EntryDeleted:
+		return "EntryDeleted"
+	case ChunksGarbageCollected:
+		return "ChunksGarbageCollected"
+	}
+	return "Unknown"
+}
+
+// Event is a single metadata change emitted by the Filer. Sequence is a
+// monotonically increasing, per-Filer number that subscribers can persist
+// and later pass back into Subscribe to resume from where they left off.
+type Event struct {
+	Type     EventType
+	Path     FullPath
+	OldEntry *Entry
+	NewEntry *Entry
+	Sequence uint64
+	TsNs     int64
+}
+
+// NotificationStore is implemented by a FilerStore that can durably persist
+// the event log so subscribers can resume after a disconnect. It is
+// optional: stores that do not implement it simply do not support replay,
+// and Subscribe falls back to live-only delivery.
+type NotificationStore interface {
+	AppendEvent(event *Event) (sequence uint64, err error)
+	ReadEventsSince(pathPrefix FullPath, sinceSequence uint64, limit int) ([]*Event, error)
+}
+
+// subscriberBufferSize bounds how many events a slow subscriber can lag
+// behind before it starts losing events.
+const subscriberBufferSize = 256
+
+type subscription struct {
+	pathPrefix FullPath
+	events     chan Event
+	dropped    uint64
+}
+
+// Subscribe returns a channel of Events under pathPrefix. If sinceSequence
+// is non-zero and the underlying FilerStore implements NotificationStore,
+// already-persisted events are replayed on the channel before live events
+// start flowing. The channel is closed when ctx is done.
+func (f *Filer) Subscribe(ctx context.Context, pathPrefix FullPath, sinceSequence uint64) (<-chan Event, error) {
+
+	sub := &subscription{
+		pathPrefix: pathPrefix,
+		events:     make(chan Event, subscriberBufferSize),
+	}
+
+	f.subscribersLock.Lock()
+	f.subscribers[sub] = struct{}{}
+	f.subscribersLock.Unlock()
+
+	out := make(chan Event, subscriberBufferSize)
+
+	go func() {
+		defer close(out)
+		defer f.unsubscribe(sub)
+
+		// lastSent dedupes against sub.events: the subscriber is already
+		// registered and receiving live events while this history replay
+		// runs below, so an event published in that window can show up
+		// both in the replay and on sub.events. Never sending a sequence
+		// number twice makes the overlap harmless.
+		var lastSent uint64
+
+		if sinceSequence > 0 {
+			if notificationStore, ok := f.store.(NotificationStore); ok {
+				since := sinceSequence
+				for {
+					history, err := notificationStore.ReadEventsSince(pathPrefix, since, subscriberBufferSize)
+					if err != nil {
+						glog.V(0).Infof("replay events for %s since %d: %v", pathPrefix, since, err)
+						break
+					}
+					for _, event := range history {
+						select {
+						case out <- *event:
+							lastSent = event.Sequence
+						case <-ctx.Done():
+							return
+						}
+					}
+					if len(history) < subscriberBufferSize {
+						break
+					}
+					since = lastSent
+				}
+			}
+		}
+
+		for {
+			select {
+			case event, ok := <-sub.events:
+				if !ok {
+					return
+				}
+				if event.Sequence <= lastSent {
+					continue
+				}
+				select {
+				case out <- event:
+					lastSent = event.Sequence
+				case <-ctx.Done():
+					return
+				}
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	return out, nil
+}
+
+func (f *Filer) unsubscribe(sub *subscription) {
+	f.subscribersLock.Lock()
+	defer f.subscribersLock.Unlock()
+	delete(f.subscribers, sub)
+}
+
+// publish persists event (if the store supports it) and fans it out to
+// every live subscriber whose pathPrefix matches. It never blocks on a
+// slow subscriber: when a subscriber's buffer is full, the new event is
+// dropped for that subscriber and the events already buffered are kept.
+// Dropped events can be replayed from the log only when the store
+// implements NotificationStore.
+func (f *Filer) publish(event *Event) {
+
+	event.Sequence = atomic.AddUint64(&f.eventSequence, 1)
+
+	if notificationStore, ok := f.store.(NotificationStore); ok {
+		if seq, err := notificationStore.AppendEvent(event); err != nil {
+			glog.V(0).Infof("append event %v for %s: %v", event.Type, event.Path, err)
+		} else {
+			event.Sequence = seq
+		}
+	}
+
+	f.subscribersLock.RLock()
+	defer f.subscribersLock.RUnlock()
+
+	for sub := range f.subscribers {
+		if !isUnderPathPrefix(sub.pathPrefix, event.Path) {
+			continue
+		}
+		select {
+		case sub.events <- *event:
+		default:
+			atomic.AddUint64(&sub.dropped, 1)
+			glog.V(1).Infof("subscriber for %s is lagging, dropped event %v for %s", sub.pathPrefix, event.Type, event.Path)
+		}
+	}
+}
+
+func isUnderPathPrefix(pathPrefix, path FullPath) bool {
+	if pathPrefix == "" || pathPrefix == "/" {
+		return true
+	}
+	if path == pathPrefix {
+		return true
+	}
+	return strings.HasPrefix(string(path), string(pathPrefix)+"/")
+}
@@ -0,0 +1,191 @@
+package filer2
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/chrislusf/seaweedfs/weed/glog"
+	"github.com/chrislusf/seaweedfs/weed/pb/filer_pb"
+)
+
+// snapshotsDirName is the hidden top-level folder under which every
+// snapshot of every subtree is kept, mirroring how e.g. .git or .snapshot
+// directories are conventionally hidden from normal listings.
+const snapshotsDirName = ".snapshots"
+
+// ChunkRefCountStore is implemented by a FilerStore that can keep a
+// reference count per chunk file ID. Snapshots clone entries but share the
+// underlying FileChunks, so a chunk can only be reclaimed once nothing --
+// neither the live tree nor any snapshot -- still points at it. Stores that
+// do not implement this interface are assumed to have no snapshots, and
+// chunks are deleted as soon as they are dereferenced, as before.
+type ChunkRefCountStore interface {
+	IncrementChunkRefCount(fileId string, delta int) (count int, err error)
+	GetChunkRefCount(fileId string) (count int, err error)
+}
+
+func snapshotRoot(path FullPath, name string) FullPath {
+	return FullPath(fmt.Sprintf("/%s/%s%s", snapshotsDirName, name, path))
+}
+
+// isSnapshotPath reports whether p is a clone created by CreateSnapshot (or
+// re-created by RestoreSnapshot), i.e. it lives under .snapshots/ rather
+// than being the live entry itself.
+func isSnapshotPath(p FullPath) bool {
+	return strings.HasPrefix(string(p), "/"+snapshotsDirName+"/")
+}
+
+// CreateSnapshot creates a lightweight, immutable view of the subtree rooted
+// at path under .snapshots/<name>/. Entries are cloned, but their FileChunks
+// are shared with the live tree: the chunks' reference counts are bumped so
+// that deleteChunksIfNotNew and deleteChunks won't reclaim a chunk still
+// referenced by a snapshot.
+func (f *Filer) CreateSnapshot(ctx context.Context, path FullPath, name string) error {
+
+	root, err := f.FindEntry(path)
+	if err != nil {
+		return fmt.Errorf("find %s: %v", path, err)
+	}
+
+	dest := snapshotRoot(path, name)
+	if existing, _ := f.FindEntry(dest); existing != nil {
+		return fmt.Errorf("snapshot %s already exists for %s", name, path)
+	}
+
+	// cloneSubtree only ever inserts entries mirroring the source subtree,
+	// which live at least one path segment below /.snapshots/<name> -- never
+	// an entry at that exact path. Create one explicitly, so ListSnapshots
+	// has something to enumerate.
+	marker := FullPath("/" + snapshotsDirName + "/" + name)
+	if existing, _ := f.FindEntry(marker); existing == nil {
+		if err := f.store.InsertEntry(&Entry{
+			FullPath: marker,
+			Attr:     Attr{Mode: os.ModeDir | 0755},
+		}); err != nil {
+			return fmt.Errorf("snapshot marker %s: %v", marker, err)
+		}
+	}
+
+	return f.cloneSubtree(path, root, dest)
+}
+
+func (f *Filer) cloneSubtree(srcPath FullPath, srcEntry *Entry, destPath FullPath) error {
+
+	clone := &Entry{
+		FullPath: destPath,
+		Attr:     srcEntry.Attr,
+		Chunks:   srcEntry.Chunks,
+	}
+
+	if err := f.store.InsertEntry(clone); err != nil {
+		return fmt.Errorf("snapshot entry %s: %v", destPath, err)
+	}
+
+	// Only a clone living under .snapshots/ holds a reference that needs to
+	// be paid back later: the matching decrement in DeleteEntryMetaAndData
+	// is gated on isSnapshotPath too. RestoreSnapshot also calls through
+	// here, but with destPath == the live path, so it must not bump the
+	// count again -- the chunks are already referenced by the snapshot this
+	// is restoring from, and the live tree's reference is implicit.
+	if isSnapshotPath(destPath) {
+		f.refChunks(clone.Chunks, 1)
+	}
+
+	if !srcEntry.IsDirectory() {
+		return nil
+	}
+
+	startFileName := ""
+	for {
+		children, err := f.store.ListDirectoryEntries(srcPath, startFileName, false, 1024)
+		if err != nil {
+			return fmt.Errorf("list %s: %v", srcPath, err)
+		}
+		if len(children) == 0 {
+			break
+		}
+		for _, child := range children {
+			childDest := destPath.Child(child.FullPath.Name())
+			if err := f.cloneSubtree(child.FullPath, child, childDest); err != nil {
+				return err
+			}
+		}
+		startFileName = children[len(children)-1].FullPath.Name()
+		if len(children) < 1024 {
+			break
+		}
+	}
+
+	return nil
+}
+
+// ListSnapshots returns the names of the snapshots taken of path.
+func (f *Filer) ListSnapshots(path FullPath) (names []string, err error) {
+	snapshotsDir := FullPath("/" + snapshotsDirName)
+	entries, err := f.store.ListDirectoryEntries(snapshotsDir, "", false, 0)
+	if err != nil {
+		return nil, fmt.Errorf("list %s: %v", snapshotsDir, err)
+	}
+	for _, entry := range entries {
+		name := entry.FullPath.Name()
+		if existing, _ := f.FindEntry(snapshotRoot(path, name)); existing != nil {
+			names = append(names, name)
+		}
+	}
+	return names, nil
+}
+
+// RestoreSnapshot replaces the subtree at path with the contents of the
+// named snapshot taken of it, sharing the snapshot's chunks going forward.
+func (f *Filer) RestoreSnapshot(ctx context.Context, path FullPath, name string) error {
+
+	snapshotEntry, err := f.FindEntry(snapshotRoot(path, name))
+	if err != nil {
+		return fmt.Errorf("snapshot %s for %s not found: %v", name, path, err)
+	}
+
+	if existing, _ := f.FindEntry(path); existing != nil {
+		if err := f.DeleteEntryMetaAndDataWithContext(ctx, path, true, true, false); err != nil {
+			return fmt.Errorf("remove existing %s: %v", path, err)
+		}
+	}
+
+	now := time.Now()
+	glog.V(1).Infof("restoring %s from snapshot %s taken at %v", path, name, now)
+
+	return f.cloneSubtree(snapshotEntry.FullPath, snapshotEntry, path)
+}
+
+// refChunks adjusts the reference count of every chunk by delta. A newly
+// inserted entry (or snapshot) increments; a deleted one decrements.
+func (f *Filer) refChunks(chunks []*filer_pb.FileChunk, delta int) {
+	refCountStore, ok := f.store.(ChunkRefCountStore)
+	if !ok {
+		return
+	}
+	for _, chunk := range chunks {
+		if _, err := refCountStore.IncrementChunkRefCount(chunk.FileId, delta); err != nil {
+			glog.V(0).Infof("adjust ref count for chunk %s by %d: %v", chunk.FileId, delta, err)
+		}
+	}
+}
+
+// isChunkReferenced reports whether a chunk is still referenced by the live
+// tree or any snapshot, and therefore must not be physically deleted yet.
+// Stores without ChunkRefCountStore have no snapshots, so nothing is ever
+// held back.
+func (f *Filer) isChunkReferenced(fileId string) bool {
+	refCountStore, ok := f.store.(ChunkRefCountStore)
+	if !ok {
+		return false
+	}
+	count, err := refCountStore.GetChunkRefCount(fileId)
+	if err != nil {
+		glog.V(0).Infof("get ref count for chunk %s: %v", fileId, err)
+		return false
+	}
+	return count > 0
+}
@@ -0,0 +1,152 @@
+package filer2
+
+import (
+	"context"
+	"testing"
+
+	"github.com/chrislusf/seaweedfs/weed/pb/filer_pb"
+)
+
+// TestSnapshotChunkReclaimedAfterDeletion verifies the core guarantee of
+// chunk ref-counting: a chunk shared between the live tree and a snapshot
+// must be held back from deletion while the snapshot exists, but must
+// eventually be reclaimed once both the live file and the snapshot are
+// gone -- not leaked forever.
+func TestSnapshotChunkReclaimedAfterDeletion(t *testing.T) {
+	ctx := context.Background()
+	f := NewFiler(nil)
+	f.SetStore(newMemFilerStore())
+
+	filePath := FullPath("/data/report.txt")
+	chunk := &filer_pb.FileChunk{FileId: "1,abc"}
+
+	if err := f.CreateEntryWithContext(ctx, &Entry{
+		FullPath: filePath,
+		Attr:     Attr{Mode: 0644},
+		Chunks:   []*filer_pb.FileChunk{chunk},
+	}); err != nil {
+		t.Fatalf("create file: %v", err)
+	}
+
+	if err := f.CreateSnapshot(ctx, filePath, "snap1"); err != nil {
+		t.Fatalf("create snapshot: %v", err)
+	}
+
+	if err := f.DeleteEntryMetaAndDataWithContext(ctx, filePath, false, true, false); err != nil {
+		t.Fatalf("delete live file: %v", err)
+	}
+
+	if depth := f.DeletionQueueDepth(); depth != 0 {
+		t.Fatalf("chunk is still referenced by the snapshot, should not be queued for deletion yet, got queue depth %d", depth)
+	}
+
+	snapshotPath := snapshotRoot(filePath, "snap1")
+	if err := f.DeleteEntryMetaAndDataWithContext(ctx, snapshotPath, false, true, false); err != nil {
+		t.Fatalf("delete snapshot: %v", err)
+	}
+
+	if depth := f.DeletionQueueDepth(); depth != 1 {
+		t.Fatalf("chunk should be queued for deletion once the last snapshot referencing it is gone, got queue depth %d", depth)
+	}
+}
+
+// TestRestoreSnapshotDoesNotLeakChunkRef is the regression test for
+// cloneSubtree unconditionally bumping the chunk ref count, even when
+// called from RestoreSnapshot with a live (non-snapshot) destPath. Without
+// the fix, restoring a snapshot leaves an extra, never-paid-back reference
+// on every chunk, so the chunk can never reach the deletion queue again.
+func TestRestoreSnapshotDoesNotLeakChunkRef(t *testing.T) {
+	ctx := context.Background()
+	f := NewFiler(nil)
+	f.SetStore(newMemFilerStore())
+
+	filePath := FullPath("/data/report.txt")
+	chunk := &filer_pb.FileChunk{FileId: "1,abc"}
+
+	if err := f.CreateEntryWithContext(ctx, &Entry{
+		FullPath: filePath,
+		Attr:     Attr{Mode: 0644},
+		Chunks:   []*filer_pb.FileChunk{chunk},
+	}); err != nil {
+		t.Fatalf("create file: %v", err)
+	}
+
+	if err := f.CreateSnapshot(ctx, filePath, "snap1"); err != nil {
+		t.Fatalf("create snapshot: %v", err)
+	}
+
+	if err := f.RestoreSnapshot(ctx, filePath, "snap1"); err != nil {
+		t.Fatalf("restore snapshot: %v", err)
+	}
+
+	if err := f.DeleteEntryMetaAndDataWithContext(ctx, filePath, false, true, false); err != nil {
+		t.Fatalf("delete restored live file: %v", err)
+	}
+
+	if depth := f.DeletionQueueDepth(); depth != 0 {
+		t.Fatalf("chunk is still referenced by the snapshot, should not be queued for deletion yet, got queue depth %d", depth)
+	}
+
+	snapshotPath := snapshotRoot(filePath, "snap1")
+	if err := f.DeleteEntryMetaAndDataWithContext(ctx, snapshotPath, false, true, false); err != nil {
+		t.Fatalf("delete snapshot: %v", err)
+	}
+
+	if depth := f.DeletionQueueDepth(); depth != 1 {
+		t.Fatalf("chunk should be queued for deletion once the restored file and its source snapshot are both gone, got queue depth %d", depth)
+	}
+}
+
+// TestListSnapshots is the regression test for ListSnapshots always
+// returning nil: cloneSubtree never inserted an entry at exactly
+// /.snapshots/<name>, only entries mirroring the source subtree one or more
+// levels deeper, so the directory listing it relied on had nothing to find.
+func TestListSnapshots(t *testing.T) {
+	ctx := context.Background()
+	f := NewFiler(nil)
+	f.SetStore(newMemFilerStore())
+
+	filePath := FullPath("/data/report.txt")
+	if err := f.CreateEntryWithContext(ctx, &Entry{
+		FullPath: filePath,
+		Attr:     Attr{Mode: 0644},
+		Chunks:   []*filer_pb.FileChunk{{FileId: "1,abc"}},
+	}); err != nil {
+		t.Fatalf("create file: %v", err)
+	}
+
+	otherPath := FullPath("/data/other.txt")
+	if err := f.CreateEntryWithContext(ctx, &Entry{
+		FullPath: otherPath,
+		Attr:     Attr{Mode: 0644},
+		Chunks:   []*filer_pb.FileChunk{{FileId: "1,def"}},
+	}); err != nil {
+		t.Fatalf("create other file: %v", err)
+	}
+
+	if err := f.CreateSnapshot(ctx, filePath, "snap1"); err != nil {
+		t.Fatalf("create snapshot snap1: %v", err)
+	}
+	if err := f.CreateSnapshot(ctx, filePath, "snap2"); err != nil {
+		t.Fatalf("create snapshot snap2: %v", err)
+	}
+	if err := f.CreateSnapshot(ctx, otherPath, "snap3"); err != nil {
+		t.Fatalf("create snapshot snap3 of other path: %v", err)
+	}
+
+	names, err := f.ListSnapshots(filePath)
+	if err != nil {
+		t.Fatalf("list snapshots: %v", err)
+	}
+
+	got := map[string]bool{}
+	for _, name := range names {
+		got[name] = true
+	}
+	if len(got) != 2 || !got["snap1"] || !got["snap2"] {
+		t.Fatalf("expected [snap1 snap2] for %s, got %v", filePath, names)
+	}
+	if got["snap3"] {
+		t.Fatalf("snap3 was taken of %s, not %s, it should not be listed", otherPath, filePath)
+	}
+}